@@ -0,0 +1,544 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+// Package langsrv implements the analysis backing a Scheme language
+// server: cross-reference resolution and identifier renaming over a
+// program already parsed by the scheme package.
+//
+// The analysis walks Pair trees with scheme.MapPairs and keys every
+// occurrence off the scheme.Point of the Identifier found there, not
+// off the ranges of the pairs, so its precision is only as good as
+// the positions attached to the identifiers of the tree it is given.
+// scheme.NewParser records each identifier's start position; a tree
+// assembled by hand out of scheme.PlainPair nodes works just as well
+// as long as its identifiers carry distinct Points, while identifiers
+// left at the zero Point cannot be told apart by the queries here.
+package langsrv
+
+import (
+	"fmt"
+
+	"github.com/markkurossi/scheme"
+	"github.com/markkurossi/scheme/types"
+)
+
+// Edit is a single textual replacement, expressed as a half-open
+// byte range in the source that produced the analyzed program.
+type Edit struct {
+	From scheme.Point
+	To   scheme.Point
+	Text string
+}
+
+// symbolKind distinguishes the occurrences a symbol collects so that
+// Rename can tell a binding occurrence from a use.
+type symbolKind int
+
+const (
+	occBinding symbolKind = iota
+	occReference
+)
+
+type occurrence struct {
+	Kind  symbolKind
+	Point scheme.Point
+	Pair  scheme.Pair
+}
+
+// symbol is the accumulated information for one lexically scoped
+// identifier: its binding occurrence (if any was seen) and every
+// reference to it found during the traversal.
+type symbol struct {
+	Name    string
+	Binding *occurrence
+	Refs    []*occurrence
+	Type    *types.Type
+}
+
+// Program is a symbol table built over a single parsed program. It
+// is the entry point for every query this package exposes.
+type Program struct {
+	// scopes is ordered from innermost to outermost at the point a
+	// given form is visited; binding occurrences create their symbols
+	// in scopes[0], while a reference to a name bound in no open
+	// scope creates its symbol in the outermost scope.
+	scopes []map[string]*symbol
+	// all collects every symbol table entry ever created, across
+	// scopes, so lookups by position do not need to re-walk the
+	// scope stack.
+	all []*symbol
+}
+
+// Analyze builds a Program by traversing the given parsed form,
+// recording binding occurrences for `define`, `lambda` parameters
+// and `let`/`let*`/`letrec` bindings, and reference occurrences for
+// every other identifier use.
+//
+// Top-level `define`s are hoisted into the outermost scope before
+// the traversal proper, so that mutual recursion between top-level
+// definitions (the common `(define (f x) (g x)) (define (g y) y)`
+// shape) resolves a forward reference to `g` against the very same
+// symbol its later binding occurrence attaches to, rather than to an
+// orphan created by resolve().
+func Analyze(program scheme.Value) (*Program, error) {
+	p := &Program{
+		scopes: []map[string]*symbol{make(map[string]*symbol)},
+	}
+	if err := p.hoistDefines(program); err != nil {
+		return nil, err
+	}
+	err := scheme.MapPairs(func(idx int, pair scheme.Pair) error {
+		return p.walk(pair.Car())
+	}, program)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// hoistDefines pre-binds every top-level `(define name ...)` /
+// `(define (name . formals) ...)` form's name in the outermost
+// scope, without walking its value or body.
+func (p *Program) hoistDefines(program scheme.Value) error {
+	return scheme.MapPairs(func(idx int, pair scheme.Pair) error {
+		form, ok := pair.Car().(scheme.Pair)
+		if !ok {
+			return nil
+		}
+		head, ok := form.Car().(*scheme.Identifier)
+		if !ok || head.Name != "define" {
+			return nil
+		}
+		args, ok := scheme.ListValues(form.Cdr())
+		if !ok || len(args) < 1 {
+			return nil
+		}
+		switch target := args[0].(type) {
+		case *scheme.Identifier:
+			p.bind(target)
+		case scheme.Pair:
+			if name, ok := target.Car().(*scheme.Identifier); ok {
+				p.bind(name)
+			}
+		}
+		return nil
+	}, program)
+}
+
+func (p *Program) pushScope() {
+	p.scopes = append([]map[string]*symbol{make(map[string]*symbol)}, p.scopes...)
+}
+
+func (p *Program) popScope() {
+	p.scopes = p.scopes[1:]
+}
+
+// bind records a binding occurrence for id in the innermost scope.
+// If that scope already holds a symbol for id.Name, that same
+// symbol is reused (its Binding point updated) instead of being
+// shadowed by a new, disconnected one. This matters whether or not
+// the existing symbol already has a Binding: hoistDefines binds
+// every top-level name before the real traversal starts, so the
+// traversal's own walkDefine/walkLambda reaches the very same name
+// a second time once it gets to that define, and must attach to the
+// symbol already carrying any forward references instead of
+// orphaning them.
+func (p *Program) bind(id *scheme.Identifier) *symbol {
+	if sym, ok := p.scopes[0][id.Name]; ok {
+		sym.Binding = &occurrence{
+			Kind:  occBinding,
+			Point: id.Point,
+		}
+		if id.GlobalType != nil {
+			sym.Type = id.GlobalType
+		}
+		return sym
+	}
+
+	sym := &symbol{
+		Name: id.Name,
+		Type: id.GlobalType,
+	}
+	sym.Binding = &occurrence{
+		Kind:  occBinding,
+		Point: id.Point,
+	}
+	p.scopes[0][id.Name] = sym
+	p.all = append(p.all, sym)
+	return sym
+}
+
+// resolve finds the symbol that name refers to from the innermost
+// scope outward, recording a reference occurrence against it. If no
+// binding is visible, a free-standing symbol is created so that
+// top-level or builtin references still resolve to *something*
+// (typically the global definition, analyzed elsewhere in the same
+// program and merged by name).
+func (p *Program) resolve(id *scheme.Identifier) *symbol {
+	for _, scope := range p.scopes {
+		if sym, ok := scope[id.Name]; ok {
+			sym.Refs = append(sym.Refs, &occurrence{
+				Kind:  occReference,
+				Point: id.Point,
+			})
+			return sym
+		}
+	}
+	sym := &symbol{Name: id.Name, Type: id.GlobalType}
+	sym.Refs = append(sym.Refs, &occurrence{
+		Kind:  occReference,
+		Point: id.Point,
+	})
+	p.scopes[len(p.scopes)-1][id.Name] = sym
+	p.all = append(p.all, sym)
+	return sym
+}
+
+// walk recurses over v, classifying identifiers into binding and
+// reference occurrences for `define`, `lambda`, `let` and `let*`.
+func (p *Program) walk(v scheme.Value) error {
+	pair, ok := v.(scheme.Pair)
+	if !ok {
+		if id, ok := v.(*scheme.Identifier); ok {
+			p.resolve(id)
+		}
+		return nil
+	}
+
+	head, _ := pair.Car().(*scheme.Identifier)
+	if head != nil {
+		switch head.Name {
+		case "define":
+			return p.walkDefine(pair)
+		case "lambda":
+			return p.walkLambda(pair)
+		case "let*":
+			return p.walkSequentialLet(pair)
+		case "letrec":
+			return p.walkLetrec(pair)
+		case "let":
+			return p.walkLet(pair)
+		}
+	}
+
+	return scheme.MapPairs(func(idx int, elem scheme.Pair) error {
+		return p.walk(elem.Car())
+	}, pair)
+}
+
+func (p *Program) walkDefine(pair scheme.Pair) error {
+	args, ok := scheme.ListValues(pair.Cdr())
+	if !ok || len(args) < 1 {
+		return nil
+	}
+
+	switch target := args[0].(type) {
+	case *scheme.Identifier:
+		// (define name value)
+		p.bind(target)
+		for _, body := range args[1:] {
+			if err := p.walk(body); err != nil {
+				return err
+			}
+		}
+
+	case scheme.Pair:
+		// (define (name . formals) body ...)
+		name, _ := target.Car().(*scheme.Identifier)
+		if name != nil {
+			p.bind(name)
+		}
+		p.pushScope()
+		defer p.popScope()
+		for formals := target.Cdr(); formals != nil; {
+			switch f := formals.(type) {
+			case scheme.Pair:
+				if id, ok := f.Car().(*scheme.Identifier); ok {
+					p.bind(id)
+				}
+				formals = f.Cdr()
+			case *scheme.Identifier:
+				// Rest parameter of a variadic define.
+				p.bind(f)
+				formals = nil
+			default:
+				formals = nil
+			}
+		}
+		for _, body := range args[1:] {
+			if err := p.walk(body); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Program) walkLambda(pair scheme.Pair) error {
+	args, ok := scheme.ListValues(pair.Cdr())
+	if !ok || len(args) < 1 {
+		return nil
+	}
+
+	p.pushScope()
+	defer p.popScope()
+
+	switch formals := args[0].(type) {
+	case *scheme.Identifier:
+		p.bind(formals)
+	case scheme.Pair:
+		if err := scheme.MapPairs(func(idx int, elem scheme.Pair) error {
+			if id, ok := elem.Car().(*scheme.Identifier); ok {
+				p.bind(id)
+			}
+			return nil
+		}, formals); err != nil {
+			return err
+		}
+	}
+
+	for _, body := range args[1:] {
+		if err := p.walk(body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkLet handles `let`, whose init expressions are evaluated in
+// the enclosing scope, unlike let* and letrec.
+func (p *Program) walkLet(pair scheme.Pair) error {
+	args, ok := scheme.ListValues(pair.Cdr())
+	if !ok || len(args) < 1 {
+		return nil
+	}
+
+	binds, ok := scheme.ListValues(args[0])
+	if !ok {
+		return nil
+	}
+	for _, b := range binds {
+		bp, ok := b.(scheme.Pair)
+		if !ok {
+			continue
+		}
+		if init, ok := bp.Cdr().(scheme.Pair); ok {
+			if err := p.walk(init.Car()); err != nil {
+				return err
+			}
+		}
+	}
+
+	p.pushScope()
+	defer p.popScope()
+	for _, b := range binds {
+		bp, ok := b.(scheme.Pair)
+		if !ok {
+			continue
+		}
+		if id, ok := bp.Car().(*scheme.Identifier); ok {
+			p.bind(id)
+		}
+	}
+	for _, body := range args[1:] {
+		if err := p.walk(body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkSequentialLet handles `let*`, whose bindings are visible to
+// the init expressions of later bindings but not to their own or
+// earlier ones.
+func (p *Program) walkSequentialLet(pair scheme.Pair) error {
+	args, ok := scheme.ListValues(pair.Cdr())
+	if !ok || len(args) < 1 {
+		return nil
+	}
+
+	p.pushScope()
+	defer p.popScope()
+
+	binds, ok := scheme.ListValues(args[0])
+	if ok {
+		for _, b := range binds {
+			bp, ok := b.(scheme.Pair)
+			if !ok {
+				continue
+			}
+			if init, ok := bp.Cdr().(scheme.Pair); ok {
+				if err := p.walk(init.Car()); err != nil {
+					return err
+				}
+			}
+			if id, ok := bp.Car().(*scheme.Identifier); ok {
+				p.bind(id)
+			}
+		}
+	}
+
+	for _, body := range args[1:] {
+		if err := p.walk(body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkLetrec handles `letrec`, whose bindings are all visible to
+// every init expression (the point of letrec being mutual
+// recursion between them), so every name is bound up front before
+// any init expression is walked.
+func (p *Program) walkLetrec(pair scheme.Pair) error {
+	args, ok := scheme.ListValues(pair.Cdr())
+	if !ok || len(args) < 1 {
+		return nil
+	}
+
+	p.pushScope()
+	defer p.popScope()
+
+	binds, ok := scheme.ListValues(args[0])
+	if ok {
+		for _, b := range binds {
+			bp, ok := b.(scheme.Pair)
+			if !ok {
+				continue
+			}
+			if id, ok := bp.Car().(*scheme.Identifier); ok {
+				p.bind(id)
+			}
+		}
+		for _, b := range binds {
+			bp, ok := b.(scheme.Pair)
+			if !ok {
+				continue
+			}
+			if init, ok := bp.Cdr().(scheme.Pair); ok {
+				if err := p.walk(init.Car()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, body := range args[1:] {
+		if err := p.walk(body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// symbolAt returns the symbol with an occurrence (binding or
+// reference) at the given point.
+func (p *Program) symbolAt(at scheme.Point) *symbol {
+	for _, sym := range p.all {
+		if sym.Binding != nil && sym.Binding.Point == at {
+			return sym
+		}
+		for _, ref := range sym.Refs {
+			if ref.Point == at {
+				return sym
+			}
+		}
+	}
+	return nil
+}
+
+// FindReferences returns the location of every reference to the
+// identifier occurring at the given point, not including its
+// binding occurrence.
+func (p *Program) FindReferences(at scheme.Point) ([]scheme.Point, error) {
+	sym := p.symbolAt(at)
+	if sym == nil {
+		return nil, fmt.Errorf("langsrv: no identifier at %s", at)
+	}
+	var result []scheme.Point
+	for _, ref := range sym.Refs {
+		result = append(result, ref.Point)
+	}
+	return result, nil
+}
+
+// GotoDefinition returns the binding occurrence of the identifier at
+// the given point.
+func (p *Program) GotoDefinition(at scheme.Point) (scheme.Point, error) {
+	sym := p.symbolAt(at)
+	if sym == nil {
+		return scheme.Point{}, fmt.Errorf("langsrv: no identifier at %s", at)
+	}
+	if sym.Binding == nil {
+		return scheme.Point{}, fmt.Errorf(
+			"langsrv: %s has no local definition", sym.Name)
+	}
+	return sym.Binding.Point, nil
+}
+
+// Hover returns a short description of the identifier at the given
+// point, rendering its inferred type (see scheme.CheckTypes) through
+// the types package.
+func (p *Program) Hover(at scheme.Point) (string, error) {
+	sym := p.symbolAt(at)
+	if sym == nil {
+		return "", fmt.Errorf("langsrv: no identifier at %s", at)
+	}
+	if sym.Type == nil {
+		return sym.Name, nil
+	}
+	return fmt.Sprintf("%s : %s", sym.Name, sym.Type), nil
+}
+
+// Rename computes the edits required to rename every occurrence
+// (binding and references alike) of the identifier at the given
+// point from oldName to newName.
+func Rename(program scheme.Value, oldName, newName string, at scheme.Point) (
+	[]Edit, error) {
+
+	p, err := Analyze(program)
+	if err != nil {
+		return nil, err
+	}
+
+	sym := p.symbolAt(at)
+	if sym == nil {
+		return nil, fmt.Errorf("langsrv: no identifier at %s", at)
+	}
+	if sym.Name != oldName {
+		return nil, fmt.Errorf(
+			"langsrv: identifier at %s is %q, not %q", at, sym.Name, oldName)
+	}
+
+	var edits []Edit
+	if sym.Binding != nil {
+		edits = append(edits, Edit{
+			From: sym.Binding.Point,
+			To:   identifierEnd(sym.Binding.Point, oldName),
+			Text: newName,
+		})
+	}
+	for _, ref := range sym.Refs {
+		edits = append(edits, Edit{
+			From: ref.Point,
+			To:   identifierEnd(ref.Point, oldName),
+			Text: newName,
+		})
+	}
+	return edits, nil
+}
+
+// identifierEnd returns the point right after an occurrence of name
+// starting at from, so that From/To together span the name's full
+// byte range rather than a zero-width point at its start. Every
+// occurrence an Identifier resolves to is a single token on a
+// single line, so advancing the column by len(name) is exact.
+func identifierEnd(from scheme.Point, name string) scheme.Point {
+	return scheme.Point{
+		Line:   from.Line,
+		Column: from.Column + len(name),
+	}
+}
@@ -0,0 +1,176 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package langsrv
+
+import (
+	"testing"
+
+	"github.com/markkurossi/scheme"
+)
+
+// program builds (define (f x) (g x x)), where g is left unbound, with
+// distinct Points standing in for distinct source locations since
+// this test does not go through scheme.NewParser.
+func program() scheme.Value {
+	px := scheme.Point{Line: 1, Column: 11}
+	pf := scheme.Point{Line: 1, Column: 9}
+	pg := scheme.Point{Line: 1, Column: 15}
+	pxUse1 := scheme.Point{Line: 1, Column: 18}
+	pxUse2 := scheme.Point{Line: 1, Column: 20}
+
+	f := scheme.NewPair(&scheme.Identifier{Name: "f", Point: pf}, nil)
+	fFormals := scheme.NewPair(&scheme.Identifier{Name: "x", Point: px}, nil)
+
+	defineF := scheme.NewPair(&scheme.Identifier{Name: "define"},
+		scheme.NewPair(
+			scheme.NewPair(f.Car(), fFormals),
+			scheme.NewPair(
+				scheme.NewPair(&scheme.Identifier{Name: "g", Point: pg},
+					scheme.NewPair(&scheme.Identifier{Name: "x", Point: pxUse1},
+						scheme.NewPair(&scheme.Identifier{Name: "x", Point: pxUse2}, nil))),
+				nil)))
+
+	return scheme.NewPair(defineF, nil)
+}
+
+// mutualRecursionProgram builds:
+//
+//	(define (f x) (g x))
+//	(define (g y) y)
+//	(g 99)
+//
+// where f's call to g is a forward reference to a top-level define
+// that has not been walked yet, and the trailing (g 99) is a normal
+// reference coming after g's own define.
+func mutualRecursionProgram() scheme.Value {
+	pf := scheme.Point{Line: 1, Column: 9}
+	px := scheme.Point{Line: 1, Column: 11}
+	pgUse := scheme.Point{Line: 1, Column: 15}
+	pxUse := scheme.Point{Line: 1, Column: 17}
+
+	pg := scheme.Point{Line: 2, Column: 9}
+	py := scheme.Point{Line: 2, Column: 11}
+	pyUse := scheme.Point{Line: 2, Column: 15}
+
+	pgUse2 := scheme.Point{Line: 3, Column: 1}
+
+	defineF := scheme.NewPair(&scheme.Identifier{Name: "define"},
+		scheme.NewPair(
+			scheme.NewPair(&scheme.Identifier{Name: "f", Point: pf},
+				scheme.NewPair(&scheme.Identifier{Name: "x", Point: px}, nil)),
+			scheme.NewPair(
+				scheme.NewPair(&scheme.Identifier{Name: "g", Point: pgUse},
+					scheme.NewPair(&scheme.Identifier{Name: "x", Point: pxUse}, nil)),
+				nil)))
+
+	defineG := scheme.NewPair(&scheme.Identifier{Name: "define"},
+		scheme.NewPair(
+			scheme.NewPair(&scheme.Identifier{Name: "g", Point: pg},
+				scheme.NewPair(&scheme.Identifier{Name: "y", Point: py}, nil)),
+			scheme.NewPair(&scheme.Identifier{Name: "y", Point: pyUse}, nil)))
+
+	callG := scheme.NewPair(&scheme.Identifier{Name: "g", Point: pgUse2},
+		scheme.NewPair(scheme.Int(99), nil))
+
+	return scheme.NewPair(defineF,
+		scheme.NewPair(defineG, scheme.NewPair(callG, nil)))
+}
+
+func TestForwardReferenceResolvesToLaterDefine(t *testing.T) {
+	p, err := Analyze(mutualRecursionProgram())
+	if err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+
+	callToG := scheme.Point{Line: 1, Column: 15}
+	gBinding := scheme.Point{Line: 2, Column: 9}
+	laterCallToG := scheme.Point{Line: 3, Column: 1}
+
+	def, err := p.GotoDefinition(callToG)
+	if err != nil {
+		t.Fatalf("GotoDefinition on forward reference to g failed: %v", err)
+	}
+	if def != gBinding {
+		t.Errorf("GotoDefinition returned %v, want %v", def, gBinding)
+	}
+
+	// g is referenced once before its own define (the forward call
+	// from f) and once after (the trailing top-level call); both
+	// must resolve to the same symbol as the binding itself.
+	refs, err := p.FindReferences(gBinding)
+	if err != nil {
+		t.Fatalf("FindReferences failed: %v", err)
+	}
+	if len(refs) != 2 {
+		t.Fatalf("expected 2 references to g, got %d: %v", len(refs), refs)
+	}
+	if refs[0] != callToG || refs[1] != laterCallToG {
+		t.Errorf("expected references %v and %v, got %v",
+			callToG, laterCallToG, refs)
+	}
+}
+
+func TestFindReferences(t *testing.T) {
+	p, err := Analyze(program())
+	if err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+
+	refs, err := p.FindReferences(scheme.Point{Line: 1, Column: 11})
+	if err != nil {
+		t.Fatalf("FindReferences failed: %v", err)
+	}
+	if len(refs) != 2 {
+		t.Errorf("expected 2 references to x, got %d", len(refs))
+	}
+}
+
+func TestGotoDefinition(t *testing.T) {
+	p, err := Analyze(program())
+	if err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+
+	def, err := p.GotoDefinition(scheme.Point{Line: 1, Column: 18})
+	if err != nil {
+		t.Fatalf("GotoDefinition failed: %v", err)
+	}
+	want := scheme.Point{Line: 1, Column: 11}
+	if def != want {
+		t.Errorf("GotoDefinition returned %v, want %v", def, want)
+	}
+}
+
+func TestRenameUnknownIdentifier(t *testing.T) {
+	_, err := Rename(program(), "y", "z", scheme.Point{Line: 1, Column: 11})
+	if err == nil {
+		t.Fatalf("expected Rename to fail for mismatched name")
+	}
+}
+
+// TestRenameProducesFullRangeEdits renames x -> count and checks
+// that every edit spans the full 1-byte width of "x", not a
+// zero-width point at its start, so applying it replaces the old
+// name instead of just inserting the new one next to it.
+func TestRenameProducesFullRangeEdits(t *testing.T) {
+	edits, err := Rename(program(), "x", "count", scheme.Point{Line: 1, Column: 11})
+	if err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	// The binding occurrence plus its two references.
+	if len(edits) != 3 {
+		t.Fatalf("expected 3 edits, got %d: %v", len(edits), edits)
+	}
+	for _, e := range edits {
+		if e.Text != "count" {
+			t.Errorf("edit has wrong replacement text: %v", e)
+		}
+		if e.To.Line != e.From.Line || e.To.Column != e.From.Column+len("x") {
+			t.Errorf("edit range is not the full width of \"x\": %v", e)
+		}
+	}
+}
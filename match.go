@@ -0,0 +1,401 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package scheme
+
+import (
+	"fmt"
+
+	"github.com/markkurossi/scheme/types"
+)
+
+// ErrorNonExhaustiveMatch is signaled at runtime when a `match`
+// expression's scrutinee does not satisfy any of the expression's
+// clauses and the compiler was unable to prove exhaustiveness
+// statically.
+var ErrorNonExhaustiveMatch = fmt.Errorf("non-exhaustive match")
+
+// matchClause is a single parsed `(pattern body ...)` clause of a
+// `match` special form. Pair is the clause's own cons cell, kept
+// around so diagnostics can be reported through its Errorf, which
+// carries its source location.
+type matchClause struct {
+	Pattern Value
+	Body    Value
+	Pair    Pair
+}
+
+// parseMatchClauses splits the clause list of a `match` form into
+// its parsed representation, preserving clause order so that
+// earlier, more specific clauses shadow later, more general ones.
+func parseMatchClauses(clauses Value) ([]*matchClause, error) {
+	var result []*matchClause
+
+	err := MapPairs(func(idx int, p Pair) error {
+		clause, ok := p.Car().(Pair)
+		if !ok {
+			return p.Errorf("match: invalid clause: %v", p.Car())
+		}
+		result = append(result, &matchClause{
+			Pattern: clause.Car(),
+			Body:    clause.Cdr(),
+			Pair:    clause,
+		})
+		return nil
+	}, clauses)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// CompileMatch lowers `(match scrutinee clause ...)` into a nested
+// `(let ((tmp scrutinee)) (if test1 body1 (if test2 body2 ... fail)))`
+// tree built out of the same Pair constructors the reader produces,
+// so it can be spliced back into the program in place of the
+// original `match` form.
+//
+// While lowering, CompileMatch tracks the set of scrutinee shapes
+// still reachable after each clause (as a types.Type union) to
+// detect clauses that can never match (already covered by earlier,
+// more general clauses) and, once every clause has been consumed, a
+// non-empty remainder that means the match is not exhaustive. Both
+// are reported as warnings through a clause's own Errorf (the last
+// clause's, for a non-exhaustive match), not hard failures, since
+// the underlying value's dynamic type is not always knowable at
+// compile time.
+func CompileMatch(scrutinee Value, clauses Value) (Value, []error) {
+	parsed, err := parseMatchClauses(clauses)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	var warnings []error
+	tmp := &Identifier{Name: "__match-subject"}
+
+	// Compile every clause's pattern once, up front, and use that
+	// same forward pass to track the set of scrutinee shapes still
+	// reachable after each clause (in source order). This is what
+	// "already covered by preceding clauses" actually means; the
+	// subsequent lowering pass below walks clauses in reverse to
+	// build the nested if tree, which is an unrelated concern and
+	// must not be conflated with this one.
+	type compiled struct {
+		test  Value
+		binds []binding
+	}
+	results := make([]compiled, len(parsed))
+
+	// seenLiterals tracks the distinct literal values already
+	// matched by a preceding clause, independent of the coarse
+	// types.Type kind tracking below: a literal like 1 only ever
+	// rules out that one value, never the rest of types.Number, so
+	// exact duplicates are the only thing that can make a later
+	// literal clause provably redundant.
+	var seenLiterals []Value
+
+	remaining := types.Any
+	for i, clause := range parsed {
+		redundant := remaining != nil && types.IsEmpty(remaining)
+		if !redundant && isLiteralPattern(clause.Pattern) {
+			for _, seen := range seenLiterals {
+				if clause.Pattern.Equal(seen) {
+					redundant = true
+					break
+				}
+			}
+			seenLiterals = append(seenLiterals, clause.Pattern)
+		}
+		if redundant {
+			warnings = append(warnings, clause.Pair.Errorf(
+				"match: clause is redundant, already covered by "+
+					"preceding clauses"))
+		}
+
+		test, binds, matched, err := compilePattern(tmp, clause.Pattern)
+		if err != nil {
+			return nil, []error{err}
+		}
+		results[i] = compiled{test: test, binds: binds}
+		remaining = types.Subtract(remaining, matched)
+	}
+
+	if remaining != nil && !types.IsEmpty(remaining) {
+		format := "match: clauses are not exhaustive, %s is not covered"
+		if len(parsed) > 0 {
+			// Reported at the last clause, after which the
+			// uncovered shapes remain.
+			warnings = append(warnings,
+				parsed[len(parsed)-1].Pair.Errorf(format, remaining))
+		} else {
+			warnings = append(warnings, fmt.Errorf(format, remaining))
+		}
+	}
+
+	// Redundancy is a "simple abstract" over-approximation and can
+	// false-positive (e.g. on an unrefined `(? pred p)` guard), so a
+	// flagged clause is still lowered into the output, not dropped.
+	var body Value = NewPair(&Identifier{Name: "error"},
+		NewPair(String(ErrorNonExhaustiveMatch.Error()), nil))
+
+	for i := len(parsed) - 1; i >= 0; i-- {
+		clause := parsed[i]
+
+		var clauseBody Value = NewPair(&Identifier{Name: "begin"}, clause.Body)
+		clauseBody = wrapBindings(results[i].binds, clauseBody)
+
+		body = NewPair(&Identifier{Name: "if"},
+			NewPair(results[i].test, NewPair(clauseBody, NewPair(body, nil))))
+	}
+
+	result := NewPair(&Identifier{Name: "let"},
+		NewPair(
+			NewPair(NewPair(tmp, NewPair(scrutinee, nil)), nil),
+			NewPair(body, nil)))
+
+	return result, warnings
+}
+
+// binding records an identifier that a pattern introduces and the
+// expression, relative to the matched subject, that computes its
+// value.
+type binding struct {
+	Name  *Identifier
+	Value Value
+}
+
+func wrapBindings(binds []binding, body Value) Value {
+	if len(binds) == 0 {
+		return body
+	}
+	var letBinds Value
+	for i := len(binds) - 1; i >= 0; i-- {
+		letBinds = NewPair(NewPair(binds[i].Name,
+			NewPair(binds[i].Value, nil)), letBinds)
+	}
+	return NewPair(&Identifier{Name: "let*"},
+		NewPair(letBinds, NewPair(body, nil)))
+}
+
+// compilePattern compiles a single match pattern against the
+// subject expression, returning a boolean test expression, the
+// bindings the pattern introduces if the test succeeds, and the
+// types.Type of values the pattern matches (used for the
+// exhaustiveness/redundancy check). It fails if pattern uses a
+// construct this compiler does not (yet) support.
+//
+// Destructuring a *Bytevector or a user-introduced "struct" tag
+// pattern is deliberately out of scope here, unlike the Pair/Vector
+// cases below: the reader in this package has no literal syntax for
+// writing a bytevector pattern (`#u8(...)`, by analogy with `#(...)`
+// for vectors) to even reach this function, and there is no
+// record/struct special form anywhere in this package defining what
+// a "struct" tag's runtime shape or field accessors are, so there is
+// nothing yet to destructure against. A whole-value Bytevector
+// pattern still matches via the literal-atom case below through
+// Equal, the same as it does for String; only per-element/per-field
+// destructuring is unimplemented.
+func compilePattern(subject Value, pattern Value) (Value, []binding, *types.Type, error) {
+	switch p := pattern.(type) {
+	case *Identifier:
+		if p.Name == "_" {
+			return Boolean(true), nil, types.Any, nil
+		}
+		return Boolean(true), []binding{{Name: p, Value: subject}}, types.Any, nil
+
+	case Pair:
+		return compileListPattern(subject, p)
+
+	case *Vector:
+		return compileVectorPattern(subject, p)
+
+	case nil:
+		return NewPair(&Identifier{Name: "null?"}, NewPair(subject, nil)),
+			nil, types.Nil, nil
+
+	default:
+		// Literal atom: boolean, number, string, character, ... A
+		// literal only ever matches the one value it spells out, not
+		// every value of its kind, so unlike the other cases above it
+		// reports no matched type at all (types.Subtract/IsEmpty treat
+		// a nil type as "nothing ruled out"): claiming pattern.Type(),
+		// e.g. the whole of types.Number for the literal 1, used to
+		// make `(match x (1 "a") (2 "b"))` look exhaustive with no
+		// wildcard clause at all. Exact-duplicate literal clauses are
+		// still caught, precisely, by CompileMatch's own seenLiterals
+		// tracking rather than through this coarse type arithmetic.
+		return NewPair(&Identifier{Name: "equal?"},
+			NewPair(subject, NewPair(pattern, nil))), nil, nil, nil
+	}
+}
+
+// isLiteralPattern reports whether pattern is a literal atom, i.e.
+// falls into compilePattern's default case: anything other than an
+// identifier (wildcard or bind), a list/improper-pair pattern, a
+// vector pattern, or the empty list.
+func isLiteralPattern(pattern Value) bool {
+	switch pattern.(type) {
+	case *Identifier, Pair, *Vector, nil:
+		return false
+	default:
+		return true
+	}
+}
+
+// compileListPattern handles `quote`, `?`, `and`, `or`, fixed-length
+// lists, `(p1 . p2)` improper pairs, and `(p ...)` repeats.
+func compileListPattern(subject Value, pattern Pair) (Value, []binding, *types.Type, error) {
+	if id, ok := pattern.Car().(*Identifier); ok {
+		switch id.Name {
+		case "quote":
+			sym, _ := pattern.Cdr().(Pair)
+			if sym != nil {
+				return NewPair(&Identifier{Name: "equal?"},
+						NewPair(subject, NewPair(
+							NewPair(&Identifier{Name: "quote"},
+								NewPair(sym.Car(), nil)), nil))),
+					nil, types.Symbol, nil
+			}
+
+		case "?":
+			args, ok := ListValues(pattern.Cdr())
+			if ok && len(args) == 2 {
+				pred := args[0]
+				test, binds, t, err := compilePattern(subject, args[1])
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				guard := NewPair(&Identifier{Name: "and"},
+					NewPair(NewPair(pred, NewPair(subject, nil)),
+						NewPair(test, nil)))
+				return guard, binds, t, nil
+			}
+
+		case "and":
+			args, ok := ListValues(pattern.Cdr())
+			if ok {
+				return compileConjunction(subject, args)
+			}
+
+		case "or":
+			args, ok := ListValues(pattern.Cdr())
+			if ok {
+				return compileDisjunction(subject, args)
+			}
+		}
+	}
+
+	// `(p ...)`: the second element literal `...` turns this into a
+	// zero-or-more repeat over the tail, binding the repeated
+	// pattern's identifier to the list of matches.
+	if rest, ok := pattern.Cdr().(Pair); ok {
+		if id, ok := rest.Car().(*Identifier); ok && id.Name == "..." {
+			return compileRepeatPattern(subject, pattern.Car())
+		}
+	}
+
+	carTest, carBinds, carType, err := compilePattern(
+		NewPair(&Identifier{Name: "car"}, NewPair(subject, nil)),
+		pattern.Car())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cdrTest, cdrBinds, cdrType, err := compilePattern(
+		NewPair(&Identifier{Name: "cdr"}, NewPair(subject, nil)),
+		pattern.Cdr())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	isPair := NewPair(&Identifier{Name: "pair?"}, NewPair(subject, nil))
+	test := NewPair(&Identifier{Name: "and"},
+		NewPair(isPair, NewPair(carTest, NewPair(cdrTest, nil))))
+
+	binds := append(carBinds, cdrBinds...)
+	return test, binds, types.Pair(carType, cdrType), nil
+}
+
+func compileConjunction(subject Value, patterns []Value) (Value, []binding, *types.Type, error) {
+	var tests Value
+	var binds []binding
+	t := types.Any
+	for i := len(patterns) - 1; i >= 0; i-- {
+		test, b, pt, err := compilePattern(subject, patterns[i])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		tests = NewPair(test, tests)
+		binds = append(binds, b...)
+		t = types.Intersect(t, pt)
+	}
+	return NewPair(&Identifier{Name: "and"}, tests), binds, t, nil
+}
+
+func compileDisjunction(subject Value, patterns []Value) (Value, []binding, *types.Type, error) {
+	var tests Value
+	var t *types.Type
+	for i := len(patterns) - 1; i >= 0; i-- {
+		test, _, pt, err := compilePattern(subject, patterns[i])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		tests = NewPair(test, tests)
+		t = types.Unify(t, pt)
+	}
+	// `or` patterns may bind different identifiers per branch; like
+	// most Scheme implementations we require callers to use `?` or
+	// `and` if they need bindings visible from disjuncts.
+	return NewPair(&Identifier{Name: "or"}, tests), nil, t, nil
+}
+
+// compileRepeatPattern compiles `(p ...)`. The only repeated element
+// pattern this compiler lowers is a bare identifier or wildcard,
+// which binds the whole matching tail to a list; anything else
+// (a literal, `(? pred p)`, a nested pair pattern, ...) would need
+// per-element checking that the lowering to `if`/`let*` below
+// cannot express without a generated loop, so it is rejected here
+// rather than silently accepted and only ever matching on shape.
+func compileRepeatPattern(subject Value, elem Value) (Value, []binding, *types.Type, error) {
+	id, ok := elem.(*Identifier)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf(
+			"match: (p ...) only supports a bare identifier or wildcard "+
+				"as the repeated element pattern, got %v", elem)
+	}
+	test := NewPair(&Identifier{Name: "list?"}, NewPair(subject, nil))
+	var binds []binding
+	if id.Name != "_" {
+		binds = append(binds, binding{Name: id, Value: subject})
+	}
+	return test, binds, types.Pair(types.Any, types.Any), nil
+}
+
+// compileVectorPattern handles `#(p1 ... pn)` against a Vector
+// subject.
+func compileVectorPattern(subject Value, pattern *Vector) (Value, []binding, *types.Type, error) {
+	isVector := NewPair(&Identifier{Name: "vector?"}, NewPair(subject, nil))
+	lenTest := NewPair(&Identifier{Name: "="},
+		NewPair(NewPair(&Identifier{Name: "vector-length"},
+			NewPair(subject, nil)),
+			NewPair(Int(len(pattern.Elements)), nil)))
+
+	tests := NewPair(&Identifier{Name: "and"},
+		NewPair(isVector, NewPair(lenTest, nil)))
+	var binds []binding
+
+	for i, elem := range pattern.Elements {
+		access := NewPair(&Identifier{Name: "vector-ref"},
+			NewPair(subject, NewPair(Int(i), nil)))
+		test, b, _, err := compilePattern(access, elem)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		tests = NewPair(&Identifier{Name: "and"},
+			NewPair(tests, NewPair(test, nil)))
+		binds = append(binds, b...)
+	}
+	return tests, binds, types.Vector, nil
+}
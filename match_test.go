@@ -0,0 +1,124 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package scheme
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchWildcardAlwaysMatches(t *testing.T) {
+	subject := &Identifier{Name: "x"}
+	test, binds, _, err := compilePattern(subject, &Identifier{Name: "_"})
+	if err != nil {
+		t.Fatalf("compilePattern failed: %v", err)
+	}
+	if !test.Equal(Boolean(true)) {
+		t.Errorf("wildcard pattern produced non-trivial test: %v", test)
+	}
+	if len(binds) != 0 {
+		t.Errorf("wildcard pattern should not bind, got %v", binds)
+	}
+}
+
+func TestMatchIdentifierBinds(t *testing.T) {
+	subject := &Identifier{Name: "x"}
+	_, binds, _, err := compilePattern(subject, &Identifier{Name: "n"})
+	if err != nil {
+		t.Fatalf("compilePattern failed: %v", err)
+	}
+	if len(binds) != 1 || binds[0].Name.Name != "n" {
+		t.Errorf("identifier pattern did not bind 'n', got %v", binds)
+	}
+}
+
+// TestMatchRepeatRejectsNonIdentifierElement ensures a repeated
+// pattern more complex than a bare identifier (e.g. a predicate
+// guard) is rejected at compile time rather than silently accepted
+// and matching on list shape alone, since per-element checking is
+// not implemented.
+func TestMatchRepeatRejectsNonIdentifierElement(t *testing.T) {
+	guard := NewPair(&Identifier{Name: "?"},
+		NewPair(&Identifier{Name: "number?"},
+			NewPair(&Identifier{Name: "n"}, nil)))
+	pattern := NewPair(guard, NewPair(&Identifier{Name: "..."}, nil))
+
+	_, _, _, err := compilePattern(&Identifier{Name: "x"}, pattern)
+	if err == nil {
+		t.Fatalf("expected an error for a non-identifier repeat pattern")
+	}
+}
+
+func TestMatchRedundantClauseWarns(t *testing.T) {
+	clause1 := NewPair(&Identifier{Name: "_"}, NewPair(Int(1), nil))
+	clause2 := NewPair(&Identifier{Name: "_"}, NewPair(Int(2), nil))
+	clauses := NewPair(clause1, NewPair(clause2, nil))
+
+	_, warnings := CompileMatch(&Identifier{Name: "v"}, clauses)
+	if len(warnings) == 0 {
+		t.Fatalf("expected a redundant-clause warning, got none")
+	}
+}
+
+// TestMatchDistinctLiteralsWithoutWildcardWarnNonExhaustive exercises
+// `(match x (1 "a") (2 "b"))`: only two numbers out of all of
+// types.Number are handled and there is no wildcard clause, so
+// CompileMatch must still warn that the match is not exhaustive. A
+// literal clause ruling out its whole kind, rather than just the one
+// value it spells out, used to make this look complete.
+func TestMatchDistinctLiteralsWithoutWildcardWarnNonExhaustive(t *testing.T) {
+	clause1 := NewPair(Int(1), NewPair(String("a"), nil))
+	clause2 := NewPair(Int(2), NewPair(String("b"), nil))
+	clauses := NewPair(clause1, NewPair(clause2, nil))
+
+	_, warnings := CompileMatch(&Identifier{Name: "x"}, clauses)
+	if len(warnings) == 0 {
+		t.Fatalf("expected a not-exhaustive warning, got none")
+	}
+}
+
+// TestMatchDuplicateLiteralClauseWarnsRedundant exercises
+// `(match x (1 "a") (1 "b"))`: the second clause repeats the exact
+// same literal and can never be reached, so it must still be flagged
+// as redundant even though a single literal no longer discharges its
+// whole kind from the exhaustiveness tracking.
+func TestMatchDuplicateLiteralClauseWarnsRedundant(t *testing.T) {
+	clause1 := NewPair(Int(1), NewPair(String("a"), nil))
+	clause2 := NewPair(Int(1), NewPair(String("b"), nil))
+	clauses := NewPair(clause1, NewPair(clause2, nil))
+
+	_, warnings := CompileMatch(&Identifier{Name: "x"}, clauses)
+	if len(warnings) == 0 {
+		t.Fatalf("expected a redundant-clause warning, got none")
+	}
+}
+
+// TestMatchLiteralBeforeWildcardIsNotRedundant exercises the
+// standard `(match v (1 "one") (_ "other"))` idiom: neither clause
+// covers the other, so CompileMatch must emit no warnings and, more
+// importantly, must still lower the first, literal clause into the
+// output rather than silently dropping it in favor of the wildcard.
+func TestMatchLiteralBeforeWildcardIsNotRedundant(t *testing.T) {
+	clause1 := NewPair(Int(1), NewPair(String("one"), nil))
+	clause2 := NewPair(&Identifier{Name: "_"}, NewPair(String("other"), nil))
+	clauses := NewPair(clause1, NewPair(clause2, nil))
+
+	result, warnings := CompileMatch(&Identifier{Name: "v"}, clauses)
+	if len(warnings) != 0 {
+		t.Fatalf("expected no warnings, got %v", warnings)
+	}
+
+	rendered := result.Scheme()
+	if !strings.Contains(rendered, "equal?") {
+		t.Fatalf("literal clause's test was dropped from the compiled "+
+			"output: %s", rendered)
+	}
+	if !strings.Contains(rendered, "one") {
+		t.Fatalf("literal clause's body was dropped from the compiled "+
+			"output: %s", rendered)
+	}
+}
@@ -0,0 +1,352 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package scheme
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Parser reads Scheme values, one datum at a time, from an input
+// stream. Every pair it builds is a LocationPair with an accurate
+// From/To, rather than the location-less PlainPair NewPair returns,
+// so that downstream consumers of the parsed tree (langsrv, the
+// soft type checker's diagnostics, match's clause warnings) can
+// report real source positions.
+type Parser struct {
+	name   string
+	r      *bufio.Reader
+	line   int
+	column int
+}
+
+// NewParser creates a parser that reads from r. name (typically a
+// file name) is stored on the Parser; the Points and error messages
+// the parser produces carry only line and column, not the name.
+func NewParser(name string, r io.Reader) *Parser {
+	return &Parser{
+		name:   name,
+		r:      bufio.NewReader(r),
+		line:   1,
+		column: 0,
+	}
+}
+
+// point returns the parser's current position.
+func (p *Parser) point() Point {
+	return Point{Line: p.line, Column: p.column}
+}
+
+func (p *Parser) readRune() (rune, error) {
+	r, _, err := p.r.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+	if r == '\n' {
+		p.line++
+		p.column = 0
+	} else {
+		p.column++
+	}
+	return r, nil
+}
+
+// peek returns the next byte without consuming it. It is byte, not
+// rune, based: identifiers and numbers in the programs this reads
+// are ASCII, and every multi-byte UTF-8 sequence starts with a byte
+// that cannot be confused with the single-byte delimiters parsing
+// dispatches on.
+func (p *Parser) peek() (byte, bool) {
+	b, err := p.r.Peek(1)
+	if err != nil {
+		return 0, false
+	}
+	return b[0], true
+}
+
+func isDelim(b byte) bool {
+	switch b {
+	case '(', ')', '"', ';', ' ', '\t', '\r', '\n', '\'':
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Parser) skipSpaceAndComments() error {
+	for {
+		b, ok := p.peek()
+		if !ok {
+			return nil
+		}
+		switch {
+		case b == ' ' || b == '\t' || b == '\r' || b == '\n':
+			if _, err := p.readRune(); err != nil {
+				return err
+			}
+		case b == ';':
+			for {
+				b, ok := p.peek()
+				if !ok || b == '\n' {
+					break
+				}
+				if _, err := p.readRune(); err != nil {
+					return err
+				}
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// Next reads and returns the next top-level datum. It returns
+// io.EOF once the input is exhausted.
+func (p *Parser) Next() (Value, error) {
+	if err := p.skipSpaceAndComments(); err != nil {
+		return nil, err
+	}
+	if _, ok := p.peek(); !ok {
+		return nil, io.EOF
+	}
+	return p.parseValue()
+}
+
+// parseValue reads a single datum, dispatching on its leading byte.
+func (p *Parser) parseValue() (Value, error) {
+	if err := p.skipSpaceAndComments(); err != nil {
+		return nil, err
+	}
+	b, ok := p.peek()
+	if !ok {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	switch b {
+	case '(':
+		return p.parseList()
+
+	case ')':
+		return nil, fmt.Errorf("%s: unexpected ')'", p.point())
+
+	case '\'':
+		return p.parseQuote()
+
+	case '"':
+		return p.parseString()
+
+	case '#':
+		return p.parseHash()
+
+	default:
+		return p.parseAtom()
+	}
+}
+
+// parseList parses `( datum* [. datum] )`, returning a chain of
+// LocationPair cells. Every cell's From is its own element's start
+// position; its To is set once, to the position right after the
+// closing paren is consumed, since that is genuinely when that
+// cell's range is known to be complete.
+func (p *Parser) parseList() (Value, error) {
+	if _, err := p.readRune(); err != nil { // consume '('
+		return nil, err
+	}
+
+	var froms []Point
+	var elems []Value
+	var tail Value
+
+	for {
+		if err := p.skipSpaceAndComments(); err != nil {
+			return nil, err
+		}
+		b, ok := p.peek()
+		if !ok {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if b == ')' {
+			break
+		}
+		if b == '.' && p.dotIsTailMarker() {
+			if _, err := p.readRune(); err != nil { // consume '.'
+				return nil, err
+			}
+			if err := p.skipSpaceAndComments(); err != nil {
+				return nil, err
+			}
+			t, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			tail = t
+			if err := p.skipSpaceAndComments(); err != nil {
+				return nil, err
+			}
+			b, ok := p.peek()
+			if !ok || b != ')' {
+				return nil, fmt.Errorf("%s: malformed dotted list", p.point())
+			}
+			break
+		}
+
+		from := p.point()
+		elem, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		froms = append(froms, from)
+		elems = append(elems, elem)
+	}
+
+	if _, err := p.readRune(); err != nil { // consume ')'
+		return nil, err
+	}
+	to := p.point()
+
+	result := tail
+	for i := len(elems) - 1; i >= 0; i-- {
+		result = NewLocationPair(froms[i], to, elems[i], result)
+	}
+	return result, nil
+}
+
+// dotIsTailMarker reports whether the '.' the parser is looking at
+// is the dotted-pair tail marker (a lone '.' followed by a
+// delimiter) rather than the start of a symbol or number such as
+// `.5` or `...`.
+func (p *Parser) dotIsTailMarker() bool {
+	buf, err := p.r.Peek(2)
+	if err != nil {
+		// Only one byte left before ')' or EOF; a lone '.' at the
+		// end of input cannot be a valid atom either way.
+		return true
+	}
+	return isDelim(buf[1])
+}
+
+// parseQuote parses `'datum` into `(quote datum)`.
+func (p *Parser) parseQuote() (Value, error) {
+	from := p.point()
+	if _, err := p.readRune(); err != nil { // consume '\''
+		return nil, err
+	}
+	datum, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	to := p.point()
+	return NewLocationPair(from, to, &Identifier{Name: "quote", Point: from},
+		NewLocationPair(from, to, datum, nil)), nil
+}
+
+// parseString parses a double-quoted string literal, interpreting
+// the backslash escapes the rest of the package already relies on
+// (vm_test's `\"Hello, world!\"` case).
+func (p *Parser) parseString() (Value, error) {
+	if _, err := p.readRune(); err != nil { // consume opening '"'
+		return nil, err
+	}
+	var buf []byte
+	for {
+		r, err := p.readRune()
+		if err != nil {
+			return nil, fmt.Errorf("%s: unterminated string", p.point())
+		}
+		if r == '"' {
+			break
+		}
+		if r == '\\' {
+			esc, err := p.readRune()
+			if err != nil {
+				return nil, fmt.Errorf("%s: unterminated string", p.point())
+			}
+			switch esc {
+			case 'n':
+				buf = append(buf, '\n')
+			case 't':
+				buf = append(buf, '\t')
+			case '"':
+				buf = append(buf, '"')
+			case '\\':
+				buf = append(buf, '\\')
+			default:
+				buf = append(buf, byte(esc))
+			}
+			continue
+		}
+		buf = append(buf, byte(r))
+	}
+	return String(buf), nil
+}
+
+// parseHash parses `#t`, `#f`, and `#( ... )` vector literals.
+func (p *Parser) parseHash() (Value, error) {
+	if _, err := p.readRune(); err != nil { // consume '#'
+		return nil, err
+	}
+	b, ok := p.peek()
+	if !ok {
+		return nil, io.ErrUnexpectedEOF
+	}
+	switch b {
+	case 't':
+		if _, err := p.readRune(); err != nil {
+			return nil, err
+		}
+		return Boolean(true), nil
+
+	case 'f':
+		if _, err := p.readRune(); err != nil {
+			return nil, err
+		}
+		return Boolean(false), nil
+
+	case '(':
+		list, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		elems, ok := ListValues(list)
+		if !ok {
+			return nil, fmt.Errorf("%s: malformed vector literal", p.point())
+		}
+		return &Vector{Elements: elems}, nil
+
+	default:
+		return nil, fmt.Errorf("%s: unsupported '#%c' syntax", p.point(), b)
+	}
+}
+
+// parseAtom parses a bare identifier, the `else` keyword, or a
+// decimal number.
+func (p *Parser) parseAtom() (Value, error) {
+	from := p.point()
+	var buf []byte
+	for {
+		b, ok := p.peek()
+		if !ok || isDelim(b) {
+			break
+		}
+		r, err := p.readRune()
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, byte(r))
+	}
+	s := string(buf)
+
+	if n, err := strconv.Atoi(s); err == nil {
+		return NewNumber(10, n), nil
+	}
+	if s == "else" {
+		return KwElse, nil
+	}
+	return &Identifier{Name: s, Point: from}, nil
+}
@@ -0,0 +1,41 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package scheme
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParserLocationPairs(t *testing.T) {
+	parser := NewParser("{data}", strings.NewReader("(foo\n  bar)"))
+	v, err := parser.Next()
+	if err != nil {
+		t.Fatalf("Parser.Next failed: %v", err)
+	}
+
+	pair, ok := v.(*LocationPair)
+	if !ok {
+		t.Fatalf("parser produced %T, want *LocationPair", v)
+	}
+	if pair.From().Line != 1 {
+		t.Errorf("got From().Line %d, want 1", pair.From().Line)
+	}
+
+	rest, ok := pair.Cdr().(*LocationPair)
+	if !ok {
+		t.Fatalf("second cell is %T, want *LocationPair", pair.Cdr())
+	}
+	if rest.From().Line != 2 {
+		t.Errorf("second element's From().Line is %d, want 2 (multi-line "+
+			"range not tracked)", rest.From().Line)
+	}
+	if rest.To() != pair.To() {
+		t.Errorf("cells of the same list should share To (set once the "+
+			"closing paren is consumed): %v != %v", rest.To(), pair.To())
+	}
+}
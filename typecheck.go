@@ -0,0 +1,617 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package scheme
+
+import (
+	"fmt"
+
+	"github.com/markkurossi/scheme/types"
+)
+
+// StrictTypes, when set, turns every dynamic CHECK that the type
+// checker would otherwise insert into a compile-time error.
+var StrictTypes bool
+
+// Check describes a dynamic type check that the soft type checker
+// inserted into the program because it could not statically refine
+// the operand's type to a single primitive shape.
+type Check struct {
+	Point Point
+	Op    string
+	Type  *types.Type
+}
+
+func (c *Check) String() string {
+	return fmt.Sprintf("%s: inserted (__check-%s ...) for type %s",
+		c.Point, c.Op, c.Type)
+}
+
+// tyvar is a type variable used while solving constraints. Variables
+// are unified through union-find; Type is non-nil once the variable
+// has been bound to a concrete (possibly union) type.
+type tyvar struct {
+	parent *tyvar
+	Type   *types.Type
+}
+
+func newTyvar() *tyvar {
+	return &tyvar{}
+}
+
+// find returns the representative variable for v's equivalence
+// class, compressing the path as it walks up.
+func (v *tyvar) find() *tyvar {
+	for v.parent != nil {
+		if v.parent.parent != nil {
+			v.parent = v.parent.parent
+		}
+		v = v.parent
+	}
+	return v
+}
+
+// checker holds the state accumulated while soft-typing a single
+// top-level program: the type environment, the union-find arena,
+// and the checks that were inserted along the way.
+//
+// env is a stack of scopes, innermost at index 0, the same layout
+// langsrv.Program uses for identifier resolution. Without it, two
+// unrelated lambdas sharing a parameter name would alias to the same
+// tyvar and get unified together incorrectly.
+type checker struct {
+	env    []map[string]*tyvar
+	checks []*Check
+}
+
+func newChecker() *checker {
+	return &checker{
+		env: []map[string]*tyvar{make(map[string]*tyvar)},
+	}
+}
+
+// pushScope opens a new, innermost scope.
+func (c *checker) pushScope() {
+	c.env = append([]map[string]*tyvar{make(map[string]*tyvar)}, c.env...)
+}
+
+// popScope discards the innermost scope.
+func (c *checker) popScope() {
+	c.env = c.env[1:]
+}
+
+// lookup returns the tyvar bound to name, searching from the
+// innermost scope out. If name is not bound anywhere, a fresh tyvar
+// is created in the outermost (global) scope: this is what lets
+// forward references to a later top-level define, and uses of
+// builtins this pass doesn't otherwise model, still get a tyvar to
+// unify through.
+func (c *checker) lookup(name string) *tyvar {
+	for _, scope := range c.env {
+		if tv, ok := scope[name]; ok {
+			return tv
+		}
+	}
+	tv := newTyvar()
+	c.env[len(c.env)-1][name] = tv
+	return tv
+}
+
+// bind introduces name as a fresh tyvar in the innermost scope,
+// shadowing any outer binding of the same name, and returns it.
+func (c *checker) bind(name string) *tyvar {
+	tv := newTyvar()
+	c.env[0][name] = tv
+	return tv
+}
+
+// unify merges the equivalence classes of a and b, widening their
+// type to the join of both when they disagree. This is what gives
+// `set!` and recursive `define` their widening behavior.
+func (c *checker) unify(a, b *tyvar) *tyvar {
+	ra, rb := a.find(), b.find()
+	if ra == rb {
+		return ra
+	}
+	ra.parent = rb
+	rb.Type = types.Unify(ra.Type, rb.Type)
+	return rb
+}
+
+// CheckTypes runs the soft type inference pass over program and
+// returns the dynamic checks it inserted. It sets
+// Identifier.GlobalType on the name of each `(define name value)`
+// form and on the target of each `set!`; a `(define (name . formals)
+// body ...)` form is not typed, and no inferred type is attached to
+// the program's Pairs themselves.
+//
+// Primitives whose operand type cannot be refined to a single
+// variant (e.g. car applied to a Pair∪Nil) are wrapped in a
+// synthesized dynamic check rather than rejected outright, unless
+// StrictTypes is set, in which case they are reported as errors.
+func CheckTypes(program Value) ([]*Check, error) {
+	c := newChecker()
+
+	err := Map(func(idx int, v Value) error {
+		_, err := c.infer(v)
+		return err
+	}, program)
+	if err != nil {
+		return nil, err
+	}
+	return c.checks, nil
+}
+
+// infer computes the type variable for v, recursing into pairs and
+// generating constraints for the primitives it recognizes.
+func (c *checker) infer(v Value) (*tyvar, error) {
+	switch vv := v.(type) {
+	case nil:
+		tv := newTyvar()
+		tv.Type = types.Nil
+		return tv, nil
+
+	case *Identifier:
+		return c.lookup(vv.Name), nil
+
+	case Pair:
+		return c.inferForm(vv)
+
+	default:
+		tv := newTyvar()
+		tv.Type = v.Type()
+		return tv, nil
+	}
+}
+
+// inferForm handles the small set of primitives and special forms
+// that this pass understands; anything else is left untyped (⊤) so
+// that later compiler stages fall back to fully dynamic dispatch.
+func (c *checker) inferForm(pair Pair) (*tyvar, error) {
+	head, ok := pair.Car().(*Identifier)
+	if !ok {
+		return newTyvar(), nil
+	}
+
+	argCells, ok := ListPairs(pair.Cdr())
+	if !ok {
+		return newTyvar(), nil
+	}
+	args := make([]Value, len(argCells))
+	for i, cell := range argCells {
+		args[i] = cell.Car()
+	}
+
+	switch head.Name {
+	case "cons":
+		if len(args) != 2 {
+			return newTyvar(), nil
+		}
+		car, err := c.infer(args[0])
+		if err != nil {
+			return nil, err
+		}
+		cdr, err := c.infer(args[1])
+		if err != nil {
+			return nil, err
+		}
+		tv := newTyvar()
+		tv.Type = types.Pair(car.find().Type, cdr.find().Type)
+		return tv, nil
+
+	case "car", "cdr":
+		if len(args) != 1 {
+			return newTyvar(), nil
+		}
+		arg, err := c.infer(args[0])
+		if err != nil {
+			return nil, err
+		}
+		t := arg.find().Type
+		if t == nil || !types.PairType.Contains(t) {
+			return newTyvar(), nil
+		}
+		if !t.IsKind(types.KindPair) {
+			if err := c.check(pair, argCells[0], head.Name, t); err != nil {
+				return nil, err
+			}
+		}
+		tv := newTyvar()
+		if head.Name == "car" {
+			tv.Type = t.Car()
+		} else {
+			tv.Type = t.Cdr()
+		}
+		return tv, nil
+
+	case "+", "-", "*", "/":
+		for i, a := range args {
+			av, err := c.infer(a)
+			if err != nil {
+				return nil, err
+			}
+			t := av.find().Type
+			if t != nil && !t.IsKind(types.KindNumber) {
+				if err := c.check(pair, argCells[i], head.Name, t); err != nil {
+					return nil, err
+				}
+			}
+		}
+		tv := newTyvar()
+		tv.Type = types.Number
+		return tv, nil
+
+	case "if":
+		if len(args) != 3 {
+			return newTyvar(), nil
+		}
+		if _, err := c.infer(args[0]); err != nil {
+			return nil, err
+		}
+		then, err := c.infer(args[1])
+		if err != nil {
+			return nil, err
+		}
+		els, err := c.infer(args[2])
+		if err != nil {
+			return nil, err
+		}
+		tv := newTyvar()
+		tv.Type = types.Unify(then.find().Type, els.find().Type)
+		return tv, nil
+
+	case "set!":
+		if len(args) != 2 {
+			return newTyvar(), nil
+		}
+		id, ok := args[0].(*Identifier)
+		if !ok {
+			return newTyvar(), nil
+		}
+		old, err := c.infer(id)
+		if err != nil {
+			return nil, err
+		}
+		val, err := c.infer(args[1])
+		if err != nil {
+			return nil, err
+		}
+		joined := c.unify(old, val)
+		id.GlobalType = joined.find().Type
+		return joined, nil
+
+	case "define":
+		if len(args) < 2 {
+			return newTyvar(), nil
+		}
+		id, ok := args[0].(*Identifier)
+		if !ok {
+			return newTyvar(), nil
+		}
+		// Reuse a tyvar already created for this name in the current
+		// scope, e.g. by a forward reference, so it unifies with the
+		// definition instead of being orphaned.
+		tv, ok := c.env[0][id.Name]
+		if !ok {
+			tv = c.bind(id.Name)
+		}
+		var val *tyvar
+		var err error
+		for _, body := range args[1:] {
+			val, err = c.infer(body)
+			if err != nil {
+				return nil, err
+			}
+		}
+		joined := c.unify(tv, val)
+		id.GlobalType = joined.find().Type
+		return joined, nil
+
+	case "lambda":
+		return c.inferLambda(args)
+
+	case "let":
+		return c.inferLet(args)
+
+	case "let*":
+		return c.inferSequentialLet(args)
+
+	case "letrec":
+		return c.inferLetrec(args)
+
+	default:
+		for _, a := range args {
+			if _, err := c.infer(a); err != nil {
+				return nil, err
+			}
+		}
+		return newTyvar(), nil
+	}
+}
+
+// bindFormals opens a new scope and binds each formal parameter
+// name to a fresh tyvar, handling both a proper list of parameters
+// and a single identifier capturing all arguments (variadic lambda).
+func (c *checker) bindFormals(formals Value) {
+	c.pushScope()
+	switch f := formals.(type) {
+	case *Identifier:
+		c.bind(f.Name)
+	default:
+		if params, ok := ListValues(f); ok {
+			for _, p := range params {
+				if id, ok := p.(*Identifier); ok {
+					c.bind(id.Name)
+				}
+			}
+		}
+	}
+}
+
+// inferLambda allocates a fresh tyvar for each parameter in its own
+// scope, so that unrelated lambdas sharing a parameter name do not
+// alias to the same variable, then infers the body for its
+// (otherwise unused, since this pass does not model function types)
+// side effects: inserted checks and GlobalType annotations.
+func (c *checker) inferLambda(args []Value) (*tyvar, error) {
+	if len(args) < 1 {
+		return newTyvar(), nil
+	}
+	c.bindFormals(args[0])
+	defer c.popScope()
+
+	for _, body := range args[1:] {
+		if _, err := c.infer(body); err != nil {
+			return nil, err
+		}
+	}
+	return newTyvar(), nil
+}
+
+// bindingName extracts the bound identifier from a `(name init)`
+// let-family binding pair.
+func bindingName(b Value) (*Identifier, Pair, bool) {
+	bp, ok := b.(Pair)
+	if !ok {
+		return nil, nil, false
+	}
+	id, ok := bp.Car().(*Identifier)
+	if !ok {
+		return nil, nil, false
+	}
+	return id, bp, true
+}
+
+// bindingInit infers the init expression of a let-family binding
+// pair, the first element after the name, and returns nil if the
+// pair has none.
+func (c *checker) bindingInit(bp Pair) (*tyvar, error) {
+	init, ok := bp.Cdr().(Pair)
+	if !ok {
+		return nil, nil
+	}
+	return c.infer(init.Car())
+}
+
+// inferLetBody infers each body form in the current scope and
+// returns the last one's tyvar, or a fresh unconstrained one if the
+// body is empty.
+func (c *checker) inferLetBody(body []Value) (*tyvar, error) {
+	var val *tyvar
+	for _, b := range body {
+		v, err := c.infer(b)
+		if err != nil {
+			return nil, err
+		}
+		val = v
+	}
+	if val == nil {
+		val = newTyvar()
+	}
+	return val, nil
+}
+
+// inferLet handles `let`, whose init expressions are evaluated in
+// the enclosing scope, unlike let* and letrec.
+func (c *checker) inferLet(args []Value) (*tyvar, error) {
+	if len(args) < 1 {
+		return newTyvar(), nil
+	}
+	binds, ok := ListValues(args[0])
+	if !ok {
+		return newTyvar(), nil
+	}
+
+	inits := make([]*tyvar, len(binds))
+	for i, b := range binds {
+		_, bp, ok := bindingName(b)
+		if !ok {
+			continue
+		}
+		init, err := c.bindingInit(bp)
+		if err != nil {
+			return nil, err
+		}
+		inits[i] = init
+	}
+
+	c.pushScope()
+	defer c.popScope()
+	for i, b := range binds {
+		id, _, ok := bindingName(b)
+		if !ok {
+			continue
+		}
+		tv := c.bind(id.Name)
+		if inits[i] != nil {
+			tv.Type = inits[i].find().Type
+		}
+	}
+	return c.inferLetBody(args[1:])
+}
+
+// inferSequentialLet handles `let*`, whose bindings come into scope
+// one at a time so that each init expression can see the ones
+// before it.
+func (c *checker) inferSequentialLet(args []Value) (*tyvar, error) {
+	if len(args) < 1 {
+		return newTyvar(), nil
+	}
+
+	c.pushScope()
+	defer c.popScope()
+
+	binds, ok := ListValues(args[0])
+	if ok {
+		for _, b := range binds {
+			id, bp, ok := bindingName(b)
+			if !ok {
+				continue
+			}
+			init, err := c.bindingInit(bp)
+			if err != nil {
+				return nil, err
+			}
+			tv := c.bind(id.Name)
+			if init != nil {
+				tv.Type = init.find().Type
+			}
+		}
+	}
+	return c.inferLetBody(args[1:])
+}
+
+// inferLetrec handles `letrec`, whose bindings are all visible to
+// every init expression (the point of letrec being mutual
+// recursion between them), so every name is bound to a fresh tyvar
+// before any init expression is inferred.
+func (c *checker) inferLetrec(args []Value) (*tyvar, error) {
+	if len(args) < 1 {
+		return newTyvar(), nil
+	}
+
+	c.pushScope()
+	defer c.popScope()
+
+	binds, ok := ListValues(args[0])
+	if ok {
+		tvs := make([]*tyvar, len(binds))
+		for i, b := range binds {
+			id, _, ok := bindingName(b)
+			if !ok {
+				continue
+			}
+			tvs[i] = c.bind(id.Name)
+		}
+		for i, b := range binds {
+			_, bp, ok := bindingName(b)
+			if !ok || tvs[i] == nil {
+				continue
+			}
+			init, err := c.bindingInit(bp)
+			if err != nil {
+				return nil, err
+			}
+			if init != nil {
+				c.unify(tvs[i], init)
+			}
+		}
+	}
+	return c.inferLetBody(args[1:])
+}
+
+// check records that a dynamic (__check-op x) guard had to be
+// inserted because op's type could not be refined to a single
+// variant, and rewrites argCell (the call's own argument cons cell)
+// in place so its element reads (__check-op element) instead of the
+// bare element. If StrictTypes is set, no guard is inserted and the
+// union type is reported as a compile-time error instead, using the
+// call form's own location.
+func (c *checker) check(pair Pair, argCell Pair, op string, t *types.Type) error {
+	if StrictTypes {
+		return pair.Errorf("%s: operand type %s is not statically safe",
+			op, t)
+	}
+	c.checks = append(c.checks, &Check{
+		Point: pair.From(),
+		Op:    op,
+		Type:  t,
+	})
+	argCell.SetCar(NewPair(&Identifier{Name: "__check-" + op},
+		NewPair(argCell.Car(), nil)))
+	return nil
+}
+
+// checkKind is the runtime counterpart of the static checks in
+// inferForm: it verifies that v's dynamic type matches kind and
+// raises through l.Errorf, in the same style as the listBuiltins
+// accessors, when it does not.
+func checkKind(l *Lambda, op string, v Value, kind types.Kind) (Value, error) {
+	if !v.Type().IsKind(kind) {
+		return nil, l.Errorf("%s: invalid operand type: %v", op, v.Type())
+	}
+	return v, nil
+}
+
+var typecheckBuiltins = []Builtin{
+	{
+		Name: "scheme-check-types",
+		Args: []string{"program"},
+		Native: func(scm *Scheme, l *Lambda, args []Value) (Value, error) {
+			checks, err := CheckTypes(args[0])
+			if err != nil {
+				return nil, err
+			}
+			var report Value
+			for i := len(checks) - 1; i >= 0; i-- {
+				report = NewPair(String(checks[i].String()), report)
+			}
+			return report, nil
+		},
+	},
+	{
+		Name: "__check-car",
+		Args: []string{"obj"},
+		Native: func(scm *Scheme, l *Lambda, args []Value) (Value, error) {
+			return checkKind(l, "car", args[0], types.KindPair)
+		},
+	},
+	{
+		Name: "__check-cdr",
+		Args: []string{"obj"},
+		Native: func(scm *Scheme, l *Lambda, args []Value) (Value, error) {
+			return checkKind(l, "cdr", args[0], types.KindPair)
+		},
+	},
+	{
+		Name: "__check-+",
+		Args: []string{"obj"},
+		Native: func(scm *Scheme, l *Lambda, args []Value) (Value, error) {
+			return checkKind(l, "+", args[0], types.KindNumber)
+		},
+	},
+	{
+		Name: "__check--",
+		Args: []string{"obj"},
+		Native: func(scm *Scheme, l *Lambda, args []Value) (Value, error) {
+			return checkKind(l, "-", args[0], types.KindNumber)
+		},
+	},
+	{
+		Name: "__check-*",
+		Args: []string{"obj"},
+		Native: func(scm *Scheme, l *Lambda, args []Value) (Value, error) {
+			return checkKind(l, "*", args[0], types.KindNumber)
+		},
+	},
+	{
+		Name: "__check-/",
+		Args: []string{"obj"},
+		Native: func(scm *Scheme, l *Lambda, args []Value) (Value, error) {
+			return checkKind(l, "/", args[0], types.KindNumber)
+		},
+	},
+}
@@ -0,0 +1,142 @@
+//
+// Copyright (c) 2023 Markku Rossi
+//
+// All rights reserved.
+//
+
+package scheme
+
+import (
+	"testing"
+)
+
+// TestCheckTypesInsertsCarCheck builds, without going through the
+// parser, the program:
+//
+//	(define x (cons 1 2))
+//	(set! x '())
+//	(car x)
+//
+// After the `set!`, x's inferred type widens to Pair∪Nil, so the
+// `car` call's argument cannot be statically refined and must be
+// wrapped in a dynamic (__check-car x) guard.
+func TestCheckTypesInsertsCarCheck(t *testing.T) {
+	x := &Identifier{Name: "x"}
+
+	define := NewPair(&Identifier{Name: "define"},
+		NewPair(x, NewPair(
+			NewPair(&Identifier{Name: "cons"},
+				NewPair(Int(1), NewPair(Int(2), nil))),
+			nil)))
+
+	set := NewPair(&Identifier{Name: "set!"},
+		NewPair(x, NewPair(nil, nil)))
+
+	call := NewPair(&Identifier{Name: "car"}, NewPair(x, nil))
+
+	program := NewPair(define, NewPair(set, NewPair(call, nil)))
+
+	checks, err := CheckTypes(program)
+	if err != nil {
+		t.Fatalf("CheckTypes failed: %v", err)
+	}
+	if len(checks) != 1 {
+		t.Fatalf("expected 1 inserted check, got %d: %v", len(checks), checks)
+	}
+	if checks[0].Op != "car" {
+		t.Errorf("expected a car check, got %q", checks[0].Op)
+	}
+
+	argCell, ok := call.Cdr().(Pair)
+	if !ok {
+		t.Fatalf("call's argument cell is not a pair: %v", call.Cdr())
+	}
+	wrapped, ok := argCell.Car().(Pair)
+	if !ok {
+		t.Fatalf("argument was not wrapped, got %v", argCell.Car())
+	}
+	op, ok := wrapped.Car().(*Identifier)
+	if !ok || op.Name != "__check-car" {
+		t.Errorf("expected wrapped call to __check-car, got %v", wrapped.Car())
+	}
+	if wrapped.Cdr().(Pair).Car() != x {
+		t.Errorf("__check-car was not applied to the original operand x")
+	}
+
+	// The call's own operator slot must be untouched: it is still a
+	// direct call to car, just with a guarded argument.
+	head, ok := call.Car().(*Identifier)
+	if !ok || head.Name != "car" {
+		t.Errorf("check rewrote the operator slot instead of the operand: %v",
+			call.Car())
+	}
+}
+
+// TestCheckTypesScopesLambdaParameters builds, without going through
+// the parser:
+//
+//	(define x (cons 1 2))
+//	(define f (lambda (x) (set! x 42)))
+//	(car x)
+//
+// f's parameter shadows the global x and is widened to Number by the
+// set! inside its own body. Without per-lambda scoping, that set!
+// would unify against the single global tyvar env["x"] instead of a
+// fresh one, widening the global x itself to Pair∪Number and causing
+// the trailing (car x) to need a dynamic check it should not need:
+// the global x was never reassigned.
+func TestCheckTypesScopesLambdaParameters(t *testing.T) {
+	globalX := &Identifier{Name: "x"}
+	defineX := NewPair(&Identifier{Name: "define"},
+		NewPair(globalX, NewPair(
+			NewPair(&Identifier{Name: "cons"},
+				NewPair(Int(1), NewPair(Int(2), nil))),
+			nil)))
+
+	paramX := &Identifier{Name: "x"}
+	defineF := NewPair(&Identifier{Name: "define"},
+		NewPair(&Identifier{Name: "f"},
+			NewPair(
+				NewPair(&Identifier{Name: "lambda"},
+					NewPair(NewPair(paramX, nil),
+						NewPair(
+							NewPair(&Identifier{Name: "set!"},
+								NewPair(paramX, NewPair(Int(42), nil))),
+							nil))),
+				nil)))
+
+	call := NewPair(&Identifier{Name: "car"}, NewPair(globalX, nil))
+
+	program := NewPair(defineX, NewPair(defineF, NewPair(call, nil)))
+
+	checks, err := CheckTypes(program)
+	if err != nil {
+		t.Fatalf("CheckTypes failed: %v", err)
+	}
+	if len(checks) != 0 {
+		t.Errorf("expected no inserted checks: f's parameter x should "+
+			"shadow the global x, not alias it, got %d: %v",
+			len(checks), checks)
+	}
+}
+
+func TestCheckTypesNoCheckForRefinedType(t *testing.T) {
+	x := &Identifier{Name: "x"}
+
+	define := NewPair(&Identifier{Name: "define"},
+		NewPair(x, NewPair(
+			NewPair(&Identifier{Name: "cons"},
+				NewPair(Int(1), NewPair(Int(2), nil))),
+			nil)))
+	call := NewPair(&Identifier{Name: "car"}, NewPair(x, nil))
+	program := NewPair(define, NewPair(call, nil))
+
+	checks, err := CheckTypes(program)
+	if err != nil {
+		t.Fatalf("CheckTypes failed: %v", err)
+	}
+	if len(checks) != 0 {
+		t.Errorf("expected no inserted checks for a statically known "+
+			"pair, got %d: %v", len(checks), checks)
+	}
+}